@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+var ErrBatchConflict = errors.New("batch has conflicting commands")
+
+// PathAccess lists the paths a command reads, writes and removes
+type PathAccess struct {
+	Reads   []string
+	Writes  []string
+	Removes []string
+}
+
+// An Accessor is a command that can tell which paths it touches before it
+// runs. Commands that are not Accessors are never part of a conflict.
+type Accessor interface {
+	Access() PathAccess
+}
+
+func (m *CmdMoveFile) Access() PathAccess {
+	return PathAccess{
+		Reads:   []string{m.SourcePath},
+		Writes:  []string{m.TargetPath},
+		Removes: []string{m.SourcePath},
+	}
+}
+func (m *CmdCopyFile) Access() PathAccess {
+	return PathAccess{Reads: []string{m.SourcePath}, Writes: []string{m.TargetPath}}
+}
+func (m *CmdAssertExists) Access() PathAccess   { return PathAccess{Reads: []string{m.Path}} }
+func (m *CmdAssertAbsent) Access() PathAccess   { return PathAccess{Reads: []string{m.Path}} }
+func (m *CmdAssertChecksum) Access() PathAccess { return PathAccess{Reads: []string{m.Path}} }
+
+func accessOf(cmd Command) PathAccess {
+	if accessor, ok := cmd.(Accessor); ok {
+		return accessor.Access()
+	}
+	return PathAccess{}
+}
+
+// ConflictKind is the wire value of a kind of conflict, documented in the
+// README
+type ConflictKind string
+
+const (
+	// two commands write the same path
+	ConflictWriteWrite ConflictKind = "write_write"
+	// a command reads a path an earlier command removed
+	ConflictUseAfterRemove ConflictKind = "use_after_remove"
+)
+
+// A Conflict is between the commands at indexes First and Second of a
+// batch, with First < Second
+type Conflict struct {
+	Kind   ConflictKind
+	Path   string
+	First  int
+	Second int
+}
+
+func (c Conflict) String() string {
+	return fmt.Sprintf("%s on %s between commands %d and %d", c.Kind, c.Path, c.First, c.Second)
+}
+
+// A ConflictDetector analyzes the commands of a batch before it runs
+type ConflictDetector interface {
+	Detect(cmds []Command) []Conflict
+}
+
+// PathConflictDetector detects write_write and use_after_remove conflicts
+// from the paths reported by Accessor commands
+type PathConflictDetector struct{}
+
+func (PathConflictDetector) Detect(cmds []Command) []Conflict {
+	accesses := make([]PathAccess, len(cmds))
+	for i, cmd := range cmds {
+		accesses[i] = accessOf(cmd)
+	}
+
+	var conflicts []Conflict
+	for j := range accesses {
+		for i := range j {
+			for _, path := range accesses[j].Writes {
+				if slices.Contains(accesses[i].Writes, path) {
+					conflicts = append(conflicts, Conflict{ConflictWriteWrite, path, i, j})
+				}
+			}
+
+			for _, path := range accesses[j].Reads {
+				if !slices.Contains(accesses[i].Removes, path) {
+					continue
+				}
+				// the path may have been recreated in between
+				recreated := slices.ContainsFunc(accesses[i+1:j], func(a PathAccess) bool {
+					return slices.Contains(a.Writes, path)
+				})
+				if !recreated {
+					conflicts = append(conflicts, Conflict{ConflictUseAfterRemove, path, i, j})
+				}
+			}
+		}
+	}
+	return conflicts
+}
+
+// ConflictPolicy is what a batch does about the conflicts found in it
+type ConflictPolicy int
+
+const (
+	// ConflictFail refuses to run a batch with conflicts
+	ConflictFail ConflictPolicy = iota
+	// ConflictReorder moves a command reading a removed path in front of
+	// the command removing it, failing if that is not safe or a conflict
+	// remains
+	ConflictReorder
+	// ConflictWarn logs the conflicts and runs the batch as is
+	ConflictWarn
+)
+
+// WithConflictDetector makes the batch check its commands with detector
+// before anything is logged, handling conflicts according to policy
+func WithConflictDetector(detector ConflictDetector, policy ConflictPolicy) BatchOption {
+	return func(b *Batch) {
+		b.conflictDetector = detector
+		b.conflictPolicy = policy
+	}
+}
+
+// resolveConflicts applies the conflict policy of the batch, possibly
+// reordering b.Commands
+func (b *Batch) resolveConflicts() error {
+	if b.conflictDetector == nil {
+		return nil
+	}
+
+	conflicts := b.conflictDetector.Detect(b.Commands)
+	if len(conflicts) == 0 {
+		return nil
+	}
+
+	switch b.conflictPolicy {
+	case ConflictWarn:
+		for _, conflict := range conflicts {
+			log.Printf("batch conflict: %s\n", conflict)
+		}
+		return nil
+	case ConflictReorder:
+		// moves are bounded in case they keep undoing each other
+		for range len(b.Commands) * len(b.Commands) {
+			if len(conflicts) == 0 {
+				return nil
+			}
+			if !b.moveBefore(conflicts[0]) {
+				break
+			}
+			conflicts = b.conflictDetector.Detect(b.Commands)
+		}
+		if len(conflicts) == 0 {
+			return nil
+		}
+	}
+
+	descriptions := make([]string, len(conflicts))
+	for i, conflict := range conflicts {
+		descriptions[i] = conflict.String()
+	}
+	return fmt.Errorf("%w: %s", ErrBatchConflict, strings.Join(descriptions, "; "))
+}
+
+// moveBefore resolves a use_after_remove conflict by moving its second
+// command in front of the first, as long as it does not touch any path
+// the commands it jumps over depend on
+func (b *Batch) moveBefore(conflict Conflict) bool {
+	if conflict.Kind != ConflictUseAfterRemove {
+		return false
+	}
+
+	moved := accessOf(b.Commands[conflict.Second])
+	for i, cmd := range b.Commands[conflict.First:conflict.Second] {
+		access := accessOf(cmd)
+		for _, path := range moved.Reads {
+			// reading before the remove being jumped is the point of the move
+			resolved := i == 0 && path == conflict.Path
+			if slices.Contains(access.Writes, path) || (slices.Contains(access.Removes, path) && !resolved) {
+				return false
+			}
+		}
+		touched := slices.Concat(access.Reads, access.Writes, access.Removes)
+		for _, path := range slices.Concat(moved.Writes, moved.Removes) {
+			if slices.Contains(touched, path) {
+				return false
+			}
+		}
+	}
+
+	cmd := b.Commands[conflict.Second]
+	b.Commands = slices.Delete(b.Commands, conflict.Second, conflict.Second+1)
+	b.Commands = slices.Insert(b.Commands, conflict.First, cmd)
+	// Order starts out as the identity on the first move, so the log always
+	// maps the executed order back to the submitted one
+	if b.Order == nil {
+		b.Order = make([]int, len(b.Commands))
+		for i := range b.Order {
+			b.Order[i] = i
+		}
+	}
+	original := b.Order[conflict.Second]
+	b.Order = slices.Delete(b.Order, conflict.Second, conflict.Second+1)
+	b.Order = slices.Insert(b.Order, conflict.First, original)
+	log.Printf("moved command %d in front of command %d to resolve %s\n", conflict.Second, conflict.First, conflict)
+	return true
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// removeCmd is an Accessor that removes a path without listing it as read,
+// like a plug-in command might
+type removeCmd struct {
+	Path string
+}
+
+func (m *removeCmd) Name() string       { return "remove" }
+func (m *removeCmd) Execute() error     { return os.Remove(m.Path) }
+func (m *removeCmd) Undo() error        { return nil }
+func (m *removeCmd) Access() PathAccess { return PathAccess{Removes: []string{m.Path}} }
+
+func writeTestFile(t *testing.T, path, data string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPathConflictDetector(t *testing.T) {
+	dir := t.TempDir()
+	x, m, y := filepath.Join(dir, "x"), filepath.Join(dir, "m"), filepath.Join(dir, "y")
+
+	tests := []struct {
+		name string
+		cmds []Command
+		want []Conflict
+	}{
+		{
+			name: "use after remove",
+			cmds: []Command{NewCmdMoveFile(x, m), NewCmdCopyFile(x, y)},
+			want: []Conflict{{ConflictUseAfterRemove, x, 0, 1}},
+		},
+		{
+			name: "recreated before use",
+			cmds: []Command{NewCmdMoveFile(x, m), NewCmdCopyFile(m, x), NewCmdCopyFile(x, y)},
+			want: nil,
+		},
+		{
+			name: "write write",
+			cmds: []Command{NewCmdCopyFile(x, y), NewCmdCopyFile(m, y)},
+			want: []Conflict{{ConflictWriteWrite, y, 0, 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PathConflictDetector{}.Detect(tt.cmds)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Detect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveConflictsReorder(t *testing.T) {
+	dir := t.TempDir()
+	x, m, y := filepath.Join(dir, "x"), filepath.Join(dir, "m"), filepath.Join(dir, "y")
+	move, cp := NewCmdMoveFile(x, m), NewCmdCopyFile(x, y)
+
+	b := NewBatch(filepath.Join(dir, "wal.yaml"), move, cp)
+	WithConflictDetector(PathConflictDetector{}, ConflictReorder)(b)
+	err := b.resolveConflicts()
+	if err != nil {
+		t.Fatalf("resolveConflicts() = %v", err)
+	}
+	if !slices.Equal(b.Commands, []Command{cp, move}) {
+		t.Errorf("commands not reordered: %v", b.Commands)
+	}
+	if want := []int{1, 0}; !slices.Equal(b.Order, want) {
+		t.Errorf("Order = %v, want %v", b.Order, want)
+	}
+}
+
+func TestResolveConflictsFail(t *testing.T) {
+	dir := t.TempDir()
+	x, m, y := filepath.Join(dir, "x"), filepath.Join(dir, "m"), filepath.Join(dir, "y")
+
+	b := NewBatch(filepath.Join(dir, "wal.yaml"), NewCmdMoveFile(x, m), NewCmdCopyFile(x, y))
+	WithConflictDetector(PathConflictDetector{}, ConflictFail)(b)
+	err := b.resolveConflicts()
+	if !errors.Is(err, ErrBatchConflict) {
+		t.Errorf("resolveConflicts() = %v, want ErrBatchConflict", err)
+	}
+}
+
+func TestResolveConflictsReorderBlockedByRemove(t *testing.T) {
+	dir := t.TempDir()
+	x, m, z := filepath.Join(dir, "x"), filepath.Join(dir, "m"), filepath.Join(dir, "z")
+
+	// moving the copy in front of the move would jump the remove of z, so
+	// z would end up removed instead of written
+	b := NewBatch(filepath.Join(dir, "wal.yaml"), NewCmdMoveFile(x, m), &removeCmd{z}, NewCmdCopyFile(x, z))
+	WithConflictDetector(PathConflictDetector{}, ConflictReorder)(b)
+	err := b.resolveConflicts()
+	if !errors.Is(err, ErrBatchConflict) {
+		t.Errorf("resolveConflicts() = %v, want ErrBatchConflict", err)
+	}
+}
+
+func TestExecuteAllConflictReorder(t *testing.T) {
+	dir := t.TempDir()
+	x, m, y := filepath.Join(dir, "x"), filepath.Join(dir, "m"), filepath.Join(dir, "y")
+	writeTestFile(t, x, "data")
+
+	b := NewBatch(filepath.Join(dir, "wal.yaml"), NewCmdMoveFile(x, m), NewCmdCopyFile(x, y))
+	err := b.ExecuteAll(WithConflictDetector(PathConflictDetector{}, ConflictReorder))
+	if err != nil {
+		t.Fatalf("ExecuteAll() = %v", err)
+	}
+
+	for _, path := range []string{m, y} {
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != "data" {
+			t.Errorf("%s = %q, %v", path, data, err)
+		}
+	}
+	if _, err := os.Stat(x); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s still exists", x)
+	}
+}
@@ -2,4 +2,4 @@ module wal
 
 go 1.24.9
 
-require github.com/goccy/go-yaml v1.18.0 // indirect
+require github.com/goccy/go-yaml v1.18.0
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/goccy/go-yaml"
+)
+
+var ErrBatchNotFound = errors.New("batch not found in WAL")
+
+// CommandState is how far a command of a loaded batch got. Its values are
+// stable and documented in the README.
+type CommandState string
+
+const (
+	CommandPending  CommandState = "pending"
+	CommandExecuted CommandState = "executed"
+	CommandUndone   CommandState = "undone"
+)
+
+// BatchStatus is how far a loaded batch as a whole got. Its values are
+// stable and documented in the README.
+type BatchStatus string
+
+const (
+	BatchRunning          BatchStatus = "running"
+	BatchDone             BatchStatus = "done"
+	BatchDeadlineExceeded BatchStatus = "deadline_exceeded"
+	BatchRollingBack      BatchStatus = "rolling_back"
+	BatchRolledBack       BatchStatus = "rolled_back"
+)
+
+// BatchState is the execution state of a batch as recorded in the WAL.
+// Commands is indexed like the commands of the batch.
+type BatchState struct {
+	Status   BatchStatus
+	Commands []CommandState
+}
+
+// loadRecord holds the union of the fields of batch_start and status_update
+// records, with commands left undecoded until their type is known
+type loadRecord struct {
+	Type      string           `yaml:"type"`
+	ID        string           `yaml:"id"`
+	WalPath   string           `yaml:"wal_path"`
+	Commands  []map[string]any `yaml:"commands"`
+	Order     []int            `yaml:"order"`
+	Stages    []int            `yaml:"stages"`
+	Namespace string           `yaml:"namespace"`
+	Action    Action           `yaml:"action"`
+	Index     int              `yaml:"index"`
+}
+
+// LoadBatch rebuilds the batch batchID from the WAL read from r, decoding its
+// commands through the registry, along with the state it was left in. Status
+// updates are attributed to the latest batch_start before them, so batches
+// sharing a WAL must not run concurrently.
+//
+// A batch logged to a namespace WAL comes back with only its Namespace name
+// set, so executing it would skip the namespace lock and retention; load it
+// with Namespace.LoadBatch instead.
+func LoadBatch(r io.Reader, batchID string) (*Batch, BatchState, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, BatchState{}, err
+	}
+
+	var records []loadRecord
+	err = yaml.Unmarshal(data, &records)
+	if err != nil {
+		return nil, BatchState{}, walCorrupt(err)
+	}
+
+	var batch *Batch
+	var state BatchState
+	inBatch := false
+	for _, record := range records {
+		if record.Type == RecordBatchStart {
+			if batch != nil {
+				break
+			}
+			inBatch = record.ID == batchID
+			if !inBatch {
+				continue
+			}
+
+			batch = &Batch{
+				Type:      record.Type,
+				ID:        record.ID,
+				WalPath:   record.WalPath,
+				Order:     record.Order,
+				Stages:    record.Stages,
+				Namespace: record.Namespace,
+			}
+			for i, raw := range record.Commands {
+				cmd, err := DecodeCommand(raw)
+				if err != nil {
+					return nil, BatchState{}, fmt.Errorf("command %d of batch %s: %w", i, batchID, err)
+				}
+				batch.Commands = append(batch.Commands, cmd)
+				state.Commands = append(state.Commands, CommandPending)
+			}
+			state.Status = BatchRunning
+			continue
+		}
+
+		if !inBatch {
+			continue
+		}
+
+		switch record.Action {
+		case ActionExecuted, ActionUndone:
+			if record.Index < 0 || record.Index >= len(state.Commands) {
+				return nil, BatchState{}, walCorrupt(fmt.Errorf("batch %s: %s record for unknown command %d", batchID, record.Action, record.Index))
+			}
+			state.Commands[record.Index] = CommandExecuted
+			if record.Action == ActionUndone {
+				state.Commands[record.Index] = CommandUndone
+			}
+		case ActionDeadlineExceeded:
+			state.Status = BatchDeadlineExceeded
+		case ActionRollbackStarted:
+			state.Status = BatchRollingBack
+		case ActionRollbackFinished:
+			state.Status = BatchRolledBack
+		case ActionBatchDone:
+			state.Status = BatchDone
+		}
+	}
+
+	if batch == nil {
+		return nil, BatchState{}, fmt.Errorf("%w: %s", ErrBatchNotFound, batchID)
+	}
+	return batch, state, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func loadTestBatch(t *testing.T, walPath, batchID string) (*Batch, BatchState, error) {
+	t.Helper()
+	walFile, err := os.Open(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer walFile.Close()
+	return LoadBatch(walFile, batchID)
+}
+
+func TestLoadBatchExecuted(t *testing.T) {
+	dir := t.TempDir()
+	x, y := filepath.Join(dir, "x"), filepath.Join(dir, "y")
+	writeTestFile(t, x, "data")
+
+	walPath := filepath.Join(dir, "wal.yaml")
+	first := NewBatch(walPath, NewCmdCopyFile(x, y), NewCmdAssertExists(y))
+	err := first.ExecuteAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a later batch in the same WAL must not leak into the first one
+	err = NewBatch(walPath, NewCmdAssertAbsent(x)).ExecuteAll()
+	if err == nil {
+		t.Fatal("second batch did not fail")
+	}
+
+	batch, state, err := loadTestBatch(t, walPath, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.ID != first.ID || batch.WalPath != walPath || len(batch.Commands) != 2 {
+		t.Fatalf("loaded batch %+v", batch)
+	}
+	copyCmd, ok := batch.Commands[0].(*CmdCopyFile)
+	if !ok || copyCmd.SourcePath != x || copyCmd.TargetPath != y {
+		t.Errorf("command 0 = %#v", batch.Commands[0])
+	}
+	want := []CommandState{CommandExecuted, CommandExecuted}
+	if state.Status != BatchDone || !slices.Equal(state.Commands, want) {
+		t.Errorf("state = %+v, want %s %v", state, BatchDone, want)
+	}
+}
+
+func TestLoadBatchRolledBack(t *testing.T) {
+	dir := t.TempDir()
+	x, y := filepath.Join(dir, "x"), filepath.Join(dir, "y")
+	writeTestFile(t, x, "data")
+
+	walPath := filepath.Join(dir, "wal.yaml")
+	b := NewBatch(walPath, NewCmdCopyFile(x, y), NewCmdAssertAbsent(x), NewCmdAssertExists(x))
+	err := b.ExecuteAll()
+	if !errors.Is(err, ErrBatchRolledBack) {
+		t.Fatalf("ExecuteAll() = %v, want ErrBatchRolledBack", err)
+	}
+
+	_, state, err := loadTestBatch(t, walPath, b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CommandState{CommandUndone, CommandPending, CommandPending}
+	if state.Status != BatchRolledBack || !slices.Equal(state.Commands, want) {
+		t.Errorf("state = %+v, want %s %v", state, BatchRolledBack, want)
+	}
+}
+
+// midRollbackWAL is a batch whose third command failed and whose process
+// died after undoing only the second one
+const midRollbackWAL = `- type: batch_start
+  id: abc
+  wal_path: /wal.yaml
+  commands:
+  - name: copy
+    source_path: /x
+    target_path: /y
+  - name: copy
+    source_path: /x
+    target_path: /z
+  - name: assert_exists
+    path: /q
+- type: status_update
+  action: executed
+  index: 0
+- type: status_update
+  action: executed
+  index: 1
+- type: status_update
+  action: rollback_started
+  index: 2
+- type: status_update
+  action: undone
+  index: 1
+  rollback_ordinal: 1
+`
+
+func TestLoadBatchMidRollback(t *testing.T) {
+	batch, state, err := LoadBatch(strings.NewReader(midRollbackWAL), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Commands) != 3 || batch.Commands[2].Name() != "assert_exists" {
+		t.Fatalf("loaded commands %v", batch.Commands)
+	}
+	want := []CommandState{CommandExecuted, CommandUndone, CommandPending}
+	if state.Status != BatchRollingBack || !slices.Equal(state.Commands, want) {
+		t.Errorf("state = %+v, want %s %v", state, BatchRollingBack, want)
+	}
+}
+
+func TestLoadBatchErrors(t *testing.T) {
+	_, _, err := LoadBatch(strings.NewReader(midRollbackWAL), "missing")
+	if !errors.Is(err, ErrBatchNotFound) {
+		t.Errorf("unknown batch: err = %v, want ErrBatchNotFound", err)
+	}
+
+	_, _, err = LoadBatch(strings.NewReader("- [: not yaml"), "abc")
+	if !errors.Is(err, ErrWALCorrupt) {
+		t.Errorf("bad YAML: err = %v, want ErrWALCorrupt", err)
+	}
+
+	outOfRange := midRollbackWAL + "- type: status_update\n  action: executed\n  index: 7\n"
+	_, _, err = LoadBatch(strings.NewReader(outOfRange), "abc")
+	if !errors.Is(err, ErrWALCorrupt) {
+		t.Errorf("unknown index: err = %v, want ErrWALCorrupt", err)
+	}
+}
+
+func TestNamespaceLoadBatch(t *testing.T) {
+	dir := t.TempDir()
+	x := filepath.Join(dir, "x")
+	writeTestFile(t, x, "data")
+
+	n := NewNamespace(dir, "project")
+	b := n.NewBatch(NewCmdAssertExists(x))
+	err := b.ExecuteAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch, state, err := n.LoadBatch(b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.namespace != n || batch.Namespace != "project" || state.Status != BatchDone {
+		t.Errorf("loaded batch %+v in state %+v", batch, state)
+	}
+}
+
+func TestLoadBatchDeadlineExceeded(t *testing.T) {
+	// the batch of midRollbackWAL, had it died after missing its deadline
+	executed := midRollbackWAL[:strings.Index(midRollbackWAL, "- type: status_update\n  action: rollback_started")]
+	deadlineWAL := executed + "- type: status_update\n  action: deadline_exceeded\n  index: 2\n"
+
+	_, state, err := LoadBatch(strings.NewReader(deadlineWAL), "abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CommandState{CommandExecuted, CommandExecuted, CommandPending}
+	if state.Status != BatchDeadlineExceeded || !slices.Equal(state.Commands, want) {
+		t.Errorf("state = %+v, want %s %v", state, BatchDeadlineExceeded, want)
+	}
+}
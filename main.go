@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/goccy/go-yaml"
 )
@@ -95,9 +101,23 @@ type CmdCopyFile struct {
 	CmdName    string `yaml:"name"`
 	SourcePath string `yaml:"source_path"`
 	TargetPath string `yaml:"target_path"`
+
+	env *ExecEnv
 }
 
+func (m *CmdCopyFile) SetEnv(env *ExecEnv) { m.env = env }
+
 func (m *CmdCopyFile) Execute() error {
+	if m.env != nil {
+		source, err := os.Open(m.SourcePath)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+
+		return m.env.writeStaged(m.TargetPath, source)
+	}
+
 	target, err := os.OpenFile(m.TargetPath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
@@ -142,16 +162,122 @@ func NewCmdCopyFile(sourcePath, targetPath string) *CmdCopyFile {
 	}
 }
 
+// Command implementation that fails the batch unless a path exists
+type CmdAssertExists struct {
+	CmdName string `yaml:"name"`
+	Path    string `yaml:"path"`
+}
+
+func (m *CmdAssertExists) Execute() error {
+	_, err := os.Stat(m.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("assertion failed: %s does not exist", m.Path)
+	}
+	return err
+}
+func (m *CmdAssertExists) Undo() error  { return nil }
+func (m *CmdAssertExists) Name() string { return m.CmdName }
+
+func NewCmdAssertExists(path string) *CmdAssertExists {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		panic(err)
+	}
+	return &CmdAssertExists{
+		CmdName: "assert_exists",
+		Path:    path,
+	}
+}
+
+// Command implementation that fails the batch if a path exists
+type CmdAssertAbsent struct {
+	CmdName string `yaml:"name"`
+	Path    string `yaml:"path"`
+}
+
+func (m *CmdAssertAbsent) Execute() error {
+	_, err := os.Stat(m.Path)
+	if err == nil {
+		return fmt.Errorf("assertion failed: %s exists", m.Path)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+func (m *CmdAssertAbsent) Undo() error  { return nil }
+func (m *CmdAssertAbsent) Name() string { return m.CmdName }
+
+func NewCmdAssertAbsent(path string) *CmdAssertAbsent {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		panic(err)
+	}
+	return &CmdAssertAbsent{
+		CmdName: "assert_absent",
+		Path:    path,
+	}
+}
+
+// Command implementation that fails the batch unless a file has the given
+// hex encoded SHA-256 checksum
+type CmdAssertChecksum struct {
+	CmdName string `yaml:"name"`
+	Path    string `yaml:"path"`
+	SHA256  string `yaml:"sha256"`
+}
+
+func (m *CmdAssertChecksum) Execute() error {
+	file, err := os.Open(m.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(sum, m.SHA256) {
+		return fmt.Errorf("assertion failed: %s has checksum %s, expected %s", m.Path, sum, m.SHA256)
+	}
+	return nil
+}
+func (m *CmdAssertChecksum) Undo() error  { return nil }
+func (m *CmdAssertChecksum) Name() string { return m.CmdName }
+
+func NewCmdAssertChecksum(path, sha256Hex string) *CmdAssertChecksum {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		panic(err)
+	}
+	return &CmdAssertChecksum{
+		CmdName: "assert_checksum",
+		Path:    path,
+		SHA256:  sha256Hex,
+	}
+}
+
 type StatusUpdate struct {
 	Type   string  `yaml:"type"`
-	Action string  `yaml:"action"`
+	Action Action  `yaml:"action"`
 	Index  int     `yaml:"index"`
 	Cmd    Command `yaml:"cmd"`
+
+	// Path is the directory of staging_created and staging_removed records
+	Path string `yaml:"path,omitempty"`
+
+	// RollbackOrdinal is the 1-based position of an undone record within
+	// its rollback, zero for every other action
+	RollbackOrdinal int `yaml:"rollback_ordinal,omitempty"`
 }
 
-func NewStatusUpdate(action string, index int, cmd Command) *StatusUpdate {
+func NewStatusUpdate(action Action, index int, cmd Command) *StatusUpdate {
 	return &StatusUpdate{
-		Type:   "status_update",
+		Type:   RecordStatusUpdate,
 		Action: action,
 		Index:  index,
 		Cmd:    cmd,
@@ -160,8 +286,26 @@ func NewStatusUpdate(action string, index int, cmd Command) *StatusUpdate {
 
 type Batch struct {
 	Type     string    `yaml:"type"`
+	ID       string    `yaml:"id"`
 	WalPath  string    `yaml:"wal_path"`
 	Commands []Command `yaml:"commands"`
+
+	// Order is set for reordered batches and Stages for optimized ones,
+	// Order holding the index each command had when the batch was created
+	// and Stages the stage it runs in during the latest execution
+	Order  []int `yaml:"order,omitempty"`
+	Stages []int `yaml:"stages,omitempty"`
+
+	// Namespace is set for batches created through a Namespace, which is
+	// locked while the batch runs and pruned once it finishes
+	Namespace string `yaml:"namespace,omitempty"`
+	namespace *Namespace
+
+	deadline         time.Time
+	conflictDetector ConflictDetector
+	conflictPolicy   ConflictPolicy
+	optimize         bool
+	parallelism      int
 }
 
 func NewBatch(walPath string, commands ...Command) *Batch {
@@ -170,14 +314,79 @@ func NewBatch(walPath string, commands ...Command) *Batch {
 		panic(err)
 	}
 	return &Batch{
-		Type:     "batch_start",
+		Type:     RecordBatchStart,
+		ID:       newBatchID(),
 		WalPath:  walPath,
 		Commands: commands,
 	}
 }
 
-func (b *Batch) ExecuteAll() error {
-	_, err := os.Stat(b.WalPath)
+func newBatchID() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+var ErrBatchDeadlineExceeded = errors.New("batch deadline exceeded")
+
+// A BatchOption configures a single execution of a batch
+type BatchOption func(*Batch)
+
+// WithBatchDeadline makes the batch roll back if it has not finished by t
+func WithBatchDeadline(t time.Time) BatchOption {
+	return func(b *Batch) { b.deadline = t }
+}
+
+// WithBatchTimeout makes the batch roll back if it has not finished within d
+// of the start of its execution
+func WithBatchTimeout(d time.Duration) BatchOption {
+	return func(b *Batch) { b.deadline = time.Now().Add(d) }
+}
+
+func (b *Batch) ExecuteAll(opts ...BatchOption) error {
+	b.deadline = time.Time{}
+	b.conflictDetector = nil
+	b.optimize = false
+	b.parallelism = 0
+	b.Stages = nil
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	err := b.resolveConflicts()
+	if err != nil {
+		return err
+	}
+	if b.optimize {
+		b.optimizeOrder()
+	}
+
+	if b.namespace != nil {
+		unlock, err := b.namespace.Lock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		// holding the lock, no other batch can be using staging directories
+		// logged in the namespace WAL
+		err = RecoverStaging(b.WalPath)
+		if err != nil {
+			return err
+		}
+
+		// the namespace is pruned however the batch ends, the explicit
+		// pruning on commit leaves nothing for this one to do
+		defer func() {
+			err := b.namespace.prune()
+			if err != nil {
+				log.Printf("pruning namespace %q failed: %v\n", b.namespace.Name, err)
+			}
+		}()
+	}
 
 	walFile, err := os.OpenFile(b.WalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -202,9 +411,8 @@ func (b *Batch) ExecuteAll() error {
 	}
 	log.Println("batch YAML has been written to WAL")
 
-	writeStatus := func(action string, cmd Command, cmdIndex int) error {
-		status := NewStatusUpdate(action, cmdIndex, cmd)
-		statusYAML, err := yaml.Marshal([]StatusUpdate{*status})
+	writeStatus := func(status StatusUpdate) error {
+		statusYAML, err := yaml.Marshal([]StatusUpdate{status})
 		if err != nil {
 			return err
 		}
@@ -219,52 +427,160 @@ func (b *Batch) ExecuteAll() error {
 			return err
 		}
 
-		log.Printf("wrote status %q\n", action)
+		log.Printf("wrote status %q\n", status.Action)
 		return nil
 	}
 
-	var applied []Command
-	for i, cmd := range b.Commands {
-		err = cmd.Execute()
-
+	env := newExecEnv(b.ID, writeStatus)
+	for _, cmd := range b.Commands {
+		if envCmd, ok := cmd.(EnvCommand); ok {
+			envCmd.SetEnv(env)
+		}
+	}
+	// staging directories are removed and the commands detached from env
+	// however the batch ends, the explicit cleanup on commit leaves nothing
+	// for this one to remove
+	defer func() {
+		err := env.Cleanup()
 		if err != nil {
-			log.Printf("command %q failed, undoing operations: %v\n", cmd.Name(), err)
-			for i, cmd := range applied {
-				err = cmd.Undo()
-
-				if err != nil {
-					panic(err)
-				}
-				err = writeStatus("undone", cmd, i)
-				if err != nil {
-					panic(err)
-				}
-				log.Printf("command %q undone\n", cmd.Name())
+			log.Printf("removing staging directories failed: %v\n", err)
+		}
+		for _, cmd := range b.Commands {
+			if envCmd, ok := cmd.(EnvCommand); ok {
+				envCmd.SetEnv(nil)
 			}
+		}
+	}()
+
+	// applied holds the indexes into b.Commands of every command that
+	// executed successfully, so undone records can point back at them
+	var applied []int
+	abort := func(cmd Command, cmdIndex int) error {
+		rollbackErr := b.rollback(writeStatus, applied, cmd, cmdIndex)
+		if rollbackErr != nil {
+			return fmt.Errorf("%w: %w", ErrRollbackFailed, rollbackErr)
+		}
+		return nil
+	}
 
-			return err
+	// the deadline is checked before every stage and once more before the
+	// batch is marked done, with the index of the first command that did not
+	// run or len(b.Commands) if all of them did
+	checkDeadline := func(cmd Command, cmdIndex int) error {
+		if b.deadline.IsZero() || time.Now().Before(b.deadline) {
+			return nil
 		}
 
-		log.Printf("command %q executed\n", cmd.Name())
-		applied = append(applied, cmd)
+		log.Printf("batch deadline %s exceeded, undoing operations\n", b.deadline.Format(time.RFC3339))
+		err := writeStatus(*NewStatusUpdate(ActionDeadlineExceeded, cmdIndex, cmd))
+		if err != nil {
+			return err
+		}
+		err = abort(cmd, cmdIndex)
+		if err != nil {
+			return err
+		}
+		return ErrBatchDeadlineExceeded
+	}
 
-		err = writeStatus("executed", cmd, i)
+	for _, bounds := range b.stageBounds() {
+		start, end := bounds[0], bounds[1]
+		err = checkDeadline(b.Commands[start], start)
 		if err != nil {
 			return err
 		}
+
+		failedIndex := -1
+		var failedErr error
+		for i, cmdErr := range b.executeStage(start, end) {
+			cmd := b.Commands[start+i]
+			if errors.Is(cmdErr, errNotRun) {
+				continue
+			}
+			if cmdErr != nil {
+				log.Printf("command %q failed: %v\n", cmd.Name(), cmdErr)
+				if failedIndex < 0 {
+					failedIndex, failedErr = start+i, cmdErr
+				}
+				continue
+			}
+
+			log.Printf("command %q executed\n", cmd.Name())
+			applied = append(applied, start+i)
+
+			err = writeStatus(*NewStatusUpdate(ActionExecuted, start+i, cmd))
+			if err != nil {
+				return err
+			}
+		}
+
+		if failedIndex >= 0 {
+			log.Println("undoing operations")
+			err = abort(b.Commands[failedIndex], failedIndex)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: %w", ErrBatchRolledBack, failedErr)
+		}
 	}
 
-	err = writeStatus("batch_done", nil, 0)
+	err = checkDeadline(nil, len(b.Commands))
 	if err != nil {
 		return err
 	}
+
+	err = writeStatus(*NewStatusUpdate(ActionBatchDone, 0, nil))
+	if err != nil {
+		return err
+	}
+
+	err = env.Cleanup()
+	if err != nil {
+		return err
+	}
+
+	if b.namespace != nil {
+		return b.namespace.prune()
+	}
 	return nil
 }
 
+// rollback undoes the applied commands in reverse order, bracketing the
+// undone records with rollback_started and rollback_finished records for the
+// failed command
+func (b *Batch) rollback(writeStatus func(StatusUpdate) error, applied []int, failed Command, failedIndex int) error {
+	status := NewStatusUpdate(ActionRollbackStarted, failedIndex, failed)
+	err := writeStatus(*status)
+	if err != nil {
+		return err
+	}
+
+	for ordinal := range applied {
+		index := applied[len(applied)-1-ordinal]
+		cmd := b.Commands[index]
+		err = cmd.Undo()
+		if err != nil {
+			return err
+		}
+
+		status := NewStatusUpdate(ActionUndone, index, cmd)
+		status.RollbackOrdinal = ordinal + 1
+		err = writeStatus(*status)
+		if err != nil {
+			return err
+		}
+		log.Printf("command %q undone\n", cmd.Name())
+	}
+
+	status = NewStatusUpdate(ActionRollbackFinished, failedIndex, nil)
+	return writeStatus(*status)
+}
+
 func main() {
 	batch := NewBatch("wal.yaml", NewCmdMoveFile("a", "b"), NewCmdCopyFile("c", "d"))
 	err := batch.ExecuteAll()
 	if err != nil {
-		panic(err)
+		log.Println(err)
 	}
+	os.Exit(ExitCode(err))
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// undoLogCmd appends its name to undone when undone, after sleeping for
+// delay when executed
+type undoLogCmd struct {
+	name   string
+	delay  time.Duration
+	undone *[]string
+}
+
+func (m *undoLogCmd) Name() string { return m.name }
+func (m *undoLogCmd) Execute() error {
+	time.Sleep(m.delay)
+	return nil
+}
+func (m *undoLogCmd) Undo() error {
+	*m.undone = append(*m.undone, m.name)
+	return nil
+}
+
+// testRecord is a status_update as written to the WAL
+type testRecord struct {
+	Action          Action `yaml:"action"`
+	Index           int    `yaml:"index"`
+	RollbackOrdinal int    `yaml:"rollback_ordinal"`
+}
+
+func readTestRecords(t *testing.T, walPath string) []testRecord {
+	t.Helper()
+	data, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var all []struct {
+		Type            string `yaml:"type"`
+		Action          Action `yaml:"action"`
+		Index           int    `yaml:"index"`
+		RollbackOrdinal int    `yaml:"rollback_ordinal"`
+	}
+	err = yaml.Unmarshal(data, &all)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []testRecord
+	for _, record := range all {
+		if record.Type == RecordStatusUpdate {
+			records = append(records, testRecord{record.Action, record.Index, record.RollbackOrdinal})
+		}
+	}
+	return records
+}
+
+func TestExecuteAllUndoesInReverseOrder(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.yaml")
+	var undone []string
+	b := NewBatch(walPath,
+		&undoLogCmd{name: "a", undone: &undone},
+		&undoLogCmd{name: "b", undone: &undone},
+		&undoLogCmd{name: "c", undone: &undone},
+		&badCmd{},
+	)
+
+	err := b.ExecuteAll()
+	if !errors.Is(err, ErrBatchRolledBack) || ExitCode(err) != ExitRolledBack {
+		t.Fatalf("ExecuteAll() = %v, want ErrBatchRolledBack", err)
+	}
+	if want := []string{"c", "b", "a"}; !slices.Equal(undone, want) {
+		t.Errorf("undo order = %v, want %v", undone, want)
+	}
+
+	want := []testRecord{
+		{ActionExecuted, 0, 0},
+		{ActionExecuted, 1, 0},
+		{ActionExecuted, 2, 0},
+		{ActionRollbackStarted, 3, 0},
+		{ActionUndone, 2, 1},
+		{ActionUndone, 1, 2},
+		{ActionUndone, 0, 3},
+		{ActionRollbackFinished, 3, 0},
+	}
+	if got := readTestRecords(t, walPath); !slices.Equal(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
+
+func TestExecuteAllDeadlineBeforeStart(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.yaml")
+	var undone []string
+	b := NewBatch(walPath, &undoLogCmd{name: "a", undone: &undone})
+
+	err := b.ExecuteAll(WithBatchTimeout(0))
+	if !errors.Is(err, ErrBatchDeadlineExceeded) || ExitCode(err) != ExitDeadlineExceeded {
+		t.Fatalf("ExecuteAll() = %v, want ErrBatchDeadlineExceeded", err)
+	}
+	if len(undone) != 0 {
+		t.Errorf("undid %v, nothing ran", undone)
+	}
+
+	want := []testRecord{
+		{ActionDeadlineExceeded, 0, 0},
+		{ActionRollbackStarted, 0, 0},
+		{ActionRollbackFinished, 0, 0},
+	}
+	if got := readTestRecords(t, walPath); !slices.Equal(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
+
+func TestExecuteAllDeadlineAfterLastCommand(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.yaml")
+	var undone []string
+	b := NewBatch(walPath, &undoLogCmd{name: "a", delay: 50 * time.Millisecond, undone: &undone})
+
+	// the deadline passes while the only command runs, so the batch has to
+	// be rolled back by the check before batch_done
+	err := b.ExecuteAll(WithBatchDeadline(time.Now().Add(20 * time.Millisecond)))
+	if !errors.Is(err, ErrBatchDeadlineExceeded) || ExitCode(err) != ExitDeadlineExceeded {
+		t.Fatalf("ExecuteAll() = %v, want ErrBatchDeadlineExceeded", err)
+	}
+	if want := []string{"a"}; !slices.Equal(undone, want) {
+		t.Errorf("undone = %v, want %v", undone, want)
+	}
+
+	want := []testRecord{
+		{ActionExecuted, 0, 0},
+		{ActionDeadlineExceeded, 1, 0},
+		{ActionRollbackStarted, 1, 0},
+		{ActionUndone, 0, 1},
+		{ActionRollbackFinished, 1, 0},
+	}
+	if got := readTestRecords(t, walPath); !slices.Equal(got, want) {
+		t.Errorf("records = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+var ErrNamespaceLocked = errors.New("namespace is locked by another batch")
+
+// A Namespace keeps the batches of one project or user in its own WAL file
+// inside a shared WAL directory, so independent pipelines never interleave
+type Namespace struct {
+	Dir  string
+	Name string
+
+	// MaxBatches is how many finished batches are retained in the namespace
+	// WAL after each batch ends, zero keeps every batch
+	MaxBatches int
+}
+
+func NewNamespace(walDir, name string) *Namespace {
+	walDir, err := filepath.Abs(walDir)
+	if err != nil {
+		panic(err)
+	}
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		panic(fmt.Sprintf("invalid namespace name %q", name))
+	}
+	return &Namespace{
+		Dir:  walDir,
+		Name: name,
+	}
+}
+
+func (n *Namespace) WalPath() string  { return filepath.Join(n.Dir, n.Name+".yaml") }
+func (n *Namespace) lockPath() string { return filepath.Join(n.Dir, n.Name+".lock") }
+
+// NewBatch creates a batch that is logged to the namespace WAL
+func (n *Namespace) NewBatch(commands ...Command) *Batch {
+	batch := NewBatch(n.WalPath(), commands...)
+	batch.Namespace = n.Name
+	batch.namespace = n
+	return batch
+}
+
+// LoadBatch is like the package level LoadBatch on the namespace WAL, and the
+// batch it returns is locked and pruned like one created by NewBatch
+func (n *Namespace) LoadBatch(batchID string) (*Batch, BatchState, error) {
+	walFile, err := os.Open(n.WalPath())
+	if err != nil {
+		return nil, BatchState{}, err
+	}
+	defer walFile.Close()
+
+	batch, state, err := LoadBatch(walFile, batchID)
+	if err != nil {
+		return nil, BatchState{}, err
+	}
+	batch.namespace = n
+	return batch, state, nil
+}
+
+// Lock takes the namespace lock file, failing with ErrNamespaceLocked if
+// another batch holds it. A lock left behind by a crash has to be removed by
+// hand once the WAL has been inspected.
+func (n *Namespace) Lock() (unlock func() error, err error) {
+	err = os.MkdirAll(n.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	lockFile, err := os.OpenFile(n.lockPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNamespaceLocked, n.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer lockFile.Close()
+
+	_, err = fmt.Fprintf(lockFile, "%d\n", os.Getpid())
+	if err != nil {
+		os.Remove(lockFile.Name())
+		return nil, err
+	}
+
+	return func() error { return os.Remove(n.lockPath()) }, nil
+}
+
+// Prune drops the oldest finished batches, with their status updates, so at
+// most MaxBatches finished ones remain in the namespace WAL. A batch is
+// finished once it logged batch_done or rollback_finished; any other batch
+// crashed or failed to roll back, so it is always kept for inspection. The WAL is rewritten rather than appended
+// to, which a Shipper notices and answers by shipping the pruned WAL as a new
+// generation.
+func (n *Namespace) Prune() error {
+	unlock, err := n.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return n.prune()
+}
+
+// prune is Prune for a caller already holding the namespace lock
+func (n *Namespace) prune() error {
+	if n.MaxBatches <= 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(n.WalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []yaml.MapSlice
+	err = yaml.UnmarshalWithOptions(data, &records, yaml.UseOrderedMap())
+	if err != nil {
+		return walCorrupt(err)
+	}
+
+	// every record up to the next batch_start belongs to the batch
+	var batches [][]yaml.MapSlice
+	var kept []yaml.MapSlice
+	for _, record := range records {
+		if record.ToMap()["type"] == RecordBatchStart {
+			batches = append(batches, nil)
+		}
+		if len(batches) == 0 {
+			kept = append(kept, record)
+			continue
+		}
+		batches[len(batches)-1] = append(batches[len(batches)-1], record)
+	}
+
+	finished := func(batch []yaml.MapSlice) bool {
+		for _, record := range batch {
+			action := record.ToMap()["action"]
+			if action == string(ActionBatchDone) || action == string(ActionRollbackFinished) {
+				return true
+			}
+		}
+		return false
+	}
+
+	excess := -n.MaxBatches
+	for _, batch := range batches {
+		if finished(batch) {
+			excess++
+		}
+	}
+
+	dropped := 0
+	for _, batch := range batches {
+		if dropped < excess && finished(batch) {
+			dropped++
+			continue
+		}
+		kept = append(kept, batch...)
+	}
+	if dropped == 0 {
+		return nil
+	}
+
+	keptYAML, err := yaml.Marshal(kept)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := n.WalPath() + ".tmp"
+	err = os.WriteFile(tmpPath, keptYAML, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, n.WalPath())
+	if err != nil {
+		return err
+	}
+	log.Printf("pruned %d batches from namespace %q\n", dropped, n.Name)
+	return nil
+}
+
+// A WalRecord holds the fields of a WAL record used by queries and recovery
+type WalRecord struct {
+	Type      string `yaml:"type"`
+	ID        string `yaml:"id"`
+	Namespace string `yaml:"namespace"`
+	Action    Action `yaml:"action"`
+	Index     int    `yaml:"index"`
+	Path      string `yaml:"path"`
+}
+
+// QueryNamespaces reads the records of the given namespaces in walDir, or of
+// every namespace when none are given, keyed by namespace name
+func QueryNamespaces(walDir string, names ...string) (map[string][]WalRecord, error) {
+	walPaths, err := filepath.Glob(filepath.Join(walDir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]WalRecord)
+	for _, walPath := range walPaths {
+		name := strings.TrimSuffix(filepath.Base(walPath), ".yaml")
+		if len(names) > 0 && !slices.Contains(names, name) {
+			continue
+		}
+
+		data, err := os.ReadFile(walPath)
+		if err != nil {
+			return nil, err
+		}
+
+		var records []WalRecord
+		err = yaml.Unmarshal(data, &records)
+		if err != nil {
+			return nil, fmt.Errorf("reading namespace %q: %w", name, walCorrupt(err))
+		}
+		for i := range records {
+			records[i].Namespace = name
+		}
+		result[name] = records
+	}
+	return result, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// unfinishedWAL is a batch whose process died before it finished
+const unfinishedWAL = `- type: batch_start
+  id: crashed
+  wal_path: /wal.yaml
+  commands:
+  - name: assert_exists
+    path: /q
+`
+
+func namespaceBatchIDs(t *testing.T, n *Namespace) []string {
+	t.Helper()
+	namespaces, err := QueryNamespaces(n.Dir, n.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, record := range namespaces[n.Name] {
+		if record.Type == RecordBatchStart {
+			ids = append(ids, record.ID)
+		}
+	}
+	return ids
+}
+
+func TestNamespacePrune(t *testing.T) {
+	dir := t.TempDir()
+	x := filepath.Join(dir, "x")
+	writeTestFile(t, x, "data")
+
+	n := NewNamespace(dir, "project")
+	n.MaxBatches = 2
+	writeTestFile(t, n.WalPath(), unfinishedWAL)
+
+	// rolled back batches are pruned too, the unfinished one never is
+	var ids []string
+	for _, cmd := range []Command{NewCmdAssertExists(x), NewCmdAssertAbsent(x), NewCmdAssertExists(x)} {
+		b := n.NewBatch(cmd)
+		b.ExecuteAll()
+		ids = append(ids, b.ID)
+	}
+
+	want := []string{"crashed", ids[1], ids[2]}
+	if got := namespaceBatchIDs(t, n); !slices.Equal(got, want) {
+		t.Errorf("batches = %v, want %v", got, want)
+	}
+}
+
+func TestNamespacePruneLocks(t *testing.T) {
+	n := NewNamespace(t.TempDir(), "project")
+	n.MaxBatches = 1
+	unlock, err := n.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	err = n.Prune()
+	if !errors.Is(err, ErrNamespaceLocked) {
+		t.Errorf("Prune() = %v, want ErrNamespaceLocked", err)
+	}
+	if _, err := os.Stat(n.WalPath()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Prune() touched the WAL of a locked namespace")
+	}
+}
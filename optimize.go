@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// WithOptimizer reorders the batch so commands that do not depend on each
+// other are grouped into stages, running up to parallelism commands of a
+// stage at once. Two commands depend on each other when they touch a common
+// path and at least one writes or removes it; commands that are not
+// Accessors depend on everything before and after them, and every command
+// after a Guard depends on it. The final order and
+// stages are logged with the batch, so recovery sees what was executed.
+func WithOptimizer(parallelism int) BatchOption {
+	return func(b *Batch) {
+		b.optimize = true
+		b.parallelism = max(parallelism, 1)
+	}
+}
+
+// A Guard is a command that only checks a precondition for the commands
+// after it, like the assertions. The optimizer never runs those commands
+// before or alongside the guard, so a failed check still stops them.
+type Guard interface {
+	Guard()
+}
+
+func (m *CmdAssertExists) Guard()   {}
+func (m *CmdAssertAbsent) Guard()   {}
+func (m *CmdAssertChecksum) Guard() {}
+
+// dependsOn reports whether a command with access later must run after a
+// command with access earlier
+func dependsOn(later, earlier PathAccess, laterOK, earlierOK bool) bool {
+	if !laterOK || !earlierOK {
+		return true
+	}
+
+	laterTouched := slices.Concat(later.Reads, later.Writes, later.Removes)
+	earlierTouched := slices.Concat(earlier.Reads, earlier.Writes, earlier.Removes)
+	laterChanged := slices.Concat(later.Writes, later.Removes)
+	earlierChanged := slices.Concat(earlier.Writes, earlier.Removes)
+
+	for _, path := range laterChanged {
+		if slices.Contains(earlierTouched, path) {
+			return true
+		}
+	}
+	for _, path := range earlierChanged {
+		if slices.Contains(laterTouched, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// optimizeOrder sorts b.Commands by stage, keeping the original order within
+// a stage, and fills in b.Order and b.Stages
+func (b *Batch) optimizeOrder() {
+	if len(b.Commands) == 0 {
+		return
+	}
+
+	accesses := make([]PathAccess, len(b.Commands))
+	accessible := make([]bool, len(b.Commands))
+	guards := make([]bool, len(b.Commands))
+	for i, cmd := range b.Commands {
+		accessor, ok := cmd.(Accessor)
+		if ok {
+			accesses[i] = accessor.Access()
+		}
+		accessible[i] = ok
+		_, guards[i] = cmd.(Guard)
+	}
+
+	// a command runs one stage after the latest command it depends on,
+	// guards only check so they may run alongside each other
+	stages := make([]int, len(b.Commands))
+	for j := range b.Commands {
+		for i := range j {
+			if stages[i] < stages[j] {
+				continue
+			}
+			if (guards[i] && !guards[j]) || dependsOn(accesses[j], accesses[i], accessible[j], accessible[i]) {
+				stages[j] = stages[i] + 1
+			}
+		}
+	}
+
+	order := make([]int, len(b.Commands))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(x, y int) int { return stages[x] - stages[y] })
+
+	commands := make([]Command, len(order))
+	b.Stages = make([]int, len(order))
+	for i, previous := range order {
+		commands[i] = b.Commands[previous]
+		b.Stages[i] = stages[previous]
+	}
+	b.Commands = commands
+
+	// a batch optimized before is already reordered, map back through the
+	// earlier order so Order keeps pointing at the original indexes
+	if b.Order != nil {
+		for i, previous := range order {
+			order[i] = b.Order[previous]
+		}
+	}
+	b.Order = order
+	log.Printf("optimized batch into %d stages\n", b.Stages[len(b.Stages)-1]+1)
+}
+
+// stageBounds splits the indexes of b.Commands into runs of the same stage,
+// one command per run when the batch was not optimized
+func (b *Batch) stageBounds() [][2]int {
+	var bounds [][2]int
+	for start := 0; start < len(b.Commands); {
+		end := start + 1
+		for b.Stages != nil && end < len(b.Commands) && b.Stages[end] == b.Stages[start] {
+			end++
+		}
+		bounds = append(bounds, [2]int{start, end})
+		start = end
+	}
+	return bounds
+}
+
+// errNotRun marks the commands of a stage skipped after an earlier one failed
+var errNotRun = errors.New("command not run")
+
+// executeStage runs b.Commands[start:end], which do not depend on each
+// other, with up to b.parallelism of them at once. Once a command fails no
+// further ones are started, those already running are waited for.
+func (b *Batch) executeStage(start, end int) []error {
+	errs := make([]error, end-start)
+	for i := range errs {
+		errs[i] = errNotRun
+	}
+	if end-start == 1 || b.parallelism <= 1 {
+		for i := start; i < end; i++ {
+			errs[i-start] = b.Commands[i].Execute()
+			if errs[i-start] != nil {
+				break
+			}
+		}
+		return errs
+	}
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	slots := make(chan struct{}, b.parallelism)
+	for i := start; i < end; i++ {
+		slots <- struct{}{}
+		// a failing command marks failed before giving up its slot
+		if failed.Load() {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := b.Commands[i].Execute()
+			if err != nil {
+				failed.Store(true)
+			}
+			errs[i-start] = err
+		}()
+	}
+	wg.Wait()
+	return errs
+}
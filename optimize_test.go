@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOptimizeOrderChain(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c, d := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c"), filepath.Join(dir, "d")
+	x, y := filepath.Join(dir, "x"), filepath.Join(dir, "y")
+
+	batch := NewBatch(filepath.Join(dir, "wal.yaml"),
+		NewCmdCopyFile(a, b),
+		NewCmdCopyFile(b, c),
+		NewCmdCopyFile(x, y),
+		NewCmdCopyFile(c, d),
+	)
+	cmds := slices.Clone(batch.Commands)
+
+	batch.optimizeOrder()
+	wantOrder, wantStages := []int{0, 2, 1, 3}, []int{0, 0, 1, 2}
+	if !slices.Equal(batch.Order, wantOrder) || !slices.Equal(batch.Stages, wantStages) {
+		t.Fatalf("Order, Stages = %v, %v, want %v, %v", batch.Order, batch.Stages, wantOrder, wantStages)
+	}
+	for i, original := range batch.Order {
+		if batch.Commands[i] != cmds[original] {
+			t.Errorf("command %d is not original command %d", i, original)
+		}
+	}
+
+	// optimizing again must keep Order relative to the original commands
+	batch.optimizeOrder()
+	if !slices.Equal(batch.Order, wantOrder) || !slices.Equal(batch.Stages, wantStages) {
+		t.Errorf("after reoptimizing Order, Stages = %v, %v, want %v, %v", batch.Order, batch.Stages, wantOrder, wantStages)
+	}
+}
+
+func TestOptimizeOrderNonAccessorIsBarrier(t *testing.T) {
+	dir := t.TempDir()
+	x := filepath.Join(dir, "x")
+
+	batch := NewBatch(filepath.Join(dir, "wal.yaml"),
+		NewCmdCopyFile(x, filepath.Join(dir, "y")),
+		&badCmd{},
+		NewCmdCopyFile(x, filepath.Join(dir, "z")),
+	)
+	batch.optimizeOrder()
+	if want := []int{0, 1, 2}; !slices.Equal(batch.Stages, want) {
+		t.Errorf("Stages = %v, want %v", batch.Stages, want)
+	}
+}
+
+// badCmd is not an Accessor and always fails
+type badCmd struct{}
+
+func (m *badCmd) Name() string   { return "bad" }
+func (m *badCmd) Execute() error { return errors.New("bad command") }
+func (m *badCmd) Undo() error    { return nil }
+
+func TestExecuteAllParallelFailure(t *testing.T) {
+	dir := t.TempDir()
+	x := filepath.Join(dir, "x")
+	writeTestFile(t, x, "data")
+	y1, y2, y3 := filepath.Join(dir, "y1"), filepath.Join(dir, "y2"), filepath.Join(dir, "y3")
+
+	walPath := filepath.Join(dir, "wal.yaml")
+	batch := NewBatch(walPath,
+		NewCmdCopyFile(x, y1),
+		NewCmdCopyFile(filepath.Join(dir, "missing"), y2),
+		NewCmdCopyFile(x, y3),
+	)
+	err := batch.ExecuteAll(WithOptimizer(4))
+	if !errors.Is(err, ErrBatchRolledBack) {
+		t.Fatalf("ExecuteAll() = %v, want ErrBatchRolledBack", err)
+	}
+	if want := []int{0, 0, 0}; !slices.Equal(batch.Stages, want) {
+		t.Errorf("Stages = %v, want %v", batch.Stages, want)
+	}
+
+	for _, path := range []string{y1, y2, y3} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists after rollback", path)
+		}
+	}
+
+	walFile, err := os.Open(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer walFile.Close()
+	_, state, err := LoadBatch(walFile, batch.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CommandState{CommandUndone, CommandPending, CommandUndone}
+	if state.Status != BatchRolledBack || !slices.Equal(state.Commands, want) {
+		t.Errorf("state = %+v, want %s %v", state, BatchRolledBack, want)
+	}
+}
+
+func TestExecuteAllResetsStages(t *testing.T) {
+	dir := t.TempDir()
+	x := filepath.Join(dir, "x")
+	writeTestFile(t, x, "data")
+
+	batch := NewBatch(filepath.Join(dir, "wal.yaml"),
+		NewCmdCopyFile(x, filepath.Join(dir, "y")),
+		NewCmdCopyFile(x, filepath.Join(dir, "z")),
+	)
+	err := batch.ExecuteAll(WithOptimizer(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Stages == nil || batch.parallelism != 2 {
+		t.Fatalf("optimized run left Stages %v, parallelism %d", batch.Stages, batch.parallelism)
+	}
+
+	err = batch.ExecuteAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batch.Stages != nil || batch.parallelism != 0 {
+		t.Errorf("plain run kept Stages %v, parallelism %d", batch.Stages, batch.parallelism)
+	}
+	if want := []int{0, 1}; !slices.Equal(batch.Order, want) {
+		t.Errorf("Order = %v, want %v", batch.Order, want)
+	}
+}
+
+func TestOptimizeOrderGuards(t *testing.T) {
+	dir := t.TempDir()
+	a, c, x, y := filepath.Join(dir, "a"), filepath.Join(dir, "c"), filepath.Join(dir, "x"), filepath.Join(dir, "y")
+
+	batch := NewBatch(filepath.Join(dir, "wal.yaml"),
+		NewCmdCopyFile(x, y),
+		NewCmdAssertExists(filepath.Join(dir, "missing")),
+		NewCmdAssertAbsent(c),
+		NewCmdMoveFile(a, c),
+	)
+	batch.optimizeOrder()
+	if want := []int{0, 0, 0, 1}; !slices.Equal(batch.Stages, want) {
+		t.Errorf("Stages = %v, want %v", batch.Stages, want)
+	}
+}
+
+func TestExecuteAllParallelGuard(t *testing.T) {
+	dir := t.TempDir()
+	a, c := filepath.Join(dir, "a"), filepath.Join(dir, "c")
+	writeTestFile(t, a, "data")
+
+	batch := NewBatch(filepath.Join(dir, "wal.yaml"),
+		NewCmdAssertExists(filepath.Join(dir, "missing")),
+		NewCmdMoveFile(a, c),
+	)
+	err := batch.ExecuteAll(WithOptimizer(4))
+	if !errors.Is(err, ErrBatchRolledBack) {
+		t.Fatalf("ExecuteAll() = %v, want ErrBatchRolledBack", err)
+	}
+	if _, err := os.Stat(a); err != nil {
+		t.Errorf("%s was moved despite the failed assertion: %v", a, err)
+	}
+	if _, err := os.Stat(c); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s exists after the failed assertion", c)
+	}
+}
+
+// delayCmd claims to write path but only sleeps for delay
+type delayCmd struct {
+	path  string
+	delay time.Duration
+	ran   atomic.Bool
+}
+
+func (m *delayCmd) Name() string { return "delay" }
+func (m *delayCmd) Execute() error {
+	time.Sleep(m.delay)
+	m.ran.Store(true)
+	return nil
+}
+func (m *delayCmd) Undo() error        { return nil }
+func (m *delayCmd) Access() PathAccess { return PathAccess{Writes: []string{m.path}} }
+
+func TestExecuteAllParallelStopsLaunching(t *testing.T) {
+	dir := t.TempDir()
+	slow := &delayCmd{path: filepath.Join(dir, "y2"), delay: 50 * time.Millisecond}
+	last := &delayCmd{path: filepath.Join(dir, "y3")}
+
+	// the failing copy frees its slot while the slow command still runs,
+	// the last command must not take it
+	batch := NewBatch(filepath.Join(dir, "wal.yaml"),
+		NewCmdCopyFile(filepath.Join(dir, "missing"), filepath.Join(dir, "y1")),
+		slow,
+		last,
+	)
+	err := batch.ExecuteAll(WithOptimizer(2))
+	if !errors.Is(err, ErrBatchRolledBack) {
+		t.Fatalf("ExecuteAll() = %v, want ErrBatchRolledBack", err)
+	}
+	if !slow.ran.Load() || last.ran.Load() {
+		t.Errorf("slow ran %t, last ran %t, want only slow", slow.ran.Load(), last.ran.Load())
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// A PlanEntry describes what a command would change if it ran now
+type PlanEntry struct {
+	Command    string   `yaml:"command"`
+	Creates    []string `yaml:"creates,omitempty"`
+	Overwrites []string `yaml:"overwrites,omitempty"`
+	Removes    []string `yaml:"removes,omitempty"`
+
+	// Bytes is an estimate of how many bytes the command writes
+	Bytes int64 `yaml:"bytes"`
+}
+
+// A Previewer is a command that can describe its changes without making them
+type Previewer interface {
+	Preview() (PlanEntry, error)
+}
+
+// A planState overlays the filesystem with the changes of the commands
+// planned so far, so a command can be previewed against what the earlier
+// commands of the batch leave behind
+type planState struct {
+	// written holds the estimated size of every path written so far
+	written map[string]int64
+	removed map[string]bool
+}
+
+func newPlanState() *planState {
+	return &planState{
+		written: make(map[string]int64),
+		removed: make(map[string]bool),
+	}
+}
+
+// stat returns the size of path and whether it exists once the planned
+// commands ran
+func (s *planState) stat(path string) (int64, bool, error) {
+	if s.removed[path] {
+		return 0, false, nil
+	}
+	if size, ok := s.written[path]; ok {
+		return size, true, nil
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Size(), true, nil
+}
+
+// apply records the changes of a planned entry
+func (s *planState) apply(entry PlanEntry) {
+	for _, path := range entry.Removes {
+		delete(s.written, path)
+		s.removed[path] = true
+	}
+	for _, path := range slices.Concat(entry.Creates, entry.Overwrites) {
+		delete(s.removed, path)
+		s.written[path] = entry.Bytes
+	}
+}
+
+// previewWrite fills in the entry for writing a copy of sourcePath to
+// targetPath
+func previewWrite(entry *PlanEntry, state *planState, sourcePath, targetPath string) error {
+	size, ok, err := state.stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("stat %s: %w", sourcePath, os.ErrNotExist)
+	}
+	entry.Bytes = size
+	return previewTarget(entry, state, targetPath)
+}
+
+// previewTarget lists targetPath under the creates or overwrites of entry
+func previewTarget(entry *PlanEntry, state *planState, targetPath string) error {
+	_, ok, err := state.stat(targetPath)
+	if err != nil {
+		return err
+	}
+	if ok {
+		entry.Overwrites = append(entry.Overwrites, targetPath)
+	} else {
+		entry.Creates = append(entry.Creates, targetPath)
+	}
+	return nil
+}
+
+// A planPreviewer is a Previewer that can be previewed against a planState,
+// so it sees the changes of the commands planned before it
+type planPreviewer interface {
+	preview(state *planState) (PlanEntry, error)
+}
+
+func (m *CmdMoveFile) preview(state *planState) (PlanEntry, error) {
+	entry := PlanEntry{Command: m.CmdName, Removes: []string{m.SourcePath}}
+	err := previewWrite(&entry, state, m.SourcePath, m.TargetPath)
+	return entry, err
+}
+func (m *CmdCopyFile) preview(state *planState) (PlanEntry, error) {
+	entry := PlanEntry{Command: m.CmdName}
+	err := previewWrite(&entry, state, m.SourcePath, m.TargetPath)
+	return entry, err
+}
+
+func (m *CmdMoveFile) Preview() (PlanEntry, error)       { return m.preview(newPlanState()) }
+func (m *CmdCopyFile) Preview() (PlanEntry, error)       { return m.preview(newPlanState()) }
+func (m *CmdAssertExists) Preview() (PlanEntry, error)   { return PlanEntry{Command: m.CmdName}, nil }
+func (m *CmdAssertAbsent) Preview() (PlanEntry, error)   { return PlanEntry{Command: m.CmdName}, nil }
+func (m *CmdAssertChecksum) Preview() (PlanEntry, error) { return PlanEntry{Command: m.CmdName}, nil }
+
+// Plan previews every command of the batch without running it or touching
+// the WAL. Commands that are not Previewers are described from the paths
+// they report as Accessors, without a byte estimate.
+//
+// The built-in commands are previewed against the filesystem as the earlier
+// commands of the batch leave it, so a move followed by a copy of the moved
+// file plans fine. Previewers defined elsewhere only see the filesystem as it
+// is now.
+func (b *Batch) Plan() ([]PlanEntry, error) {
+	state := newPlanState()
+	plan := make([]PlanEntry, len(b.Commands))
+	for i, cmd := range b.Commands {
+		entry, err := planEntry(cmd, state)
+		if err != nil {
+			return nil, fmt.Errorf("previewing command %d %q: %w", i, cmd.Name(), err)
+		}
+		state.apply(entry)
+		plan[i] = entry
+	}
+	return plan, nil
+}
+
+func planEntry(cmd Command, state *planState) (PlanEntry, error) {
+	if previewer, ok := cmd.(planPreviewer); ok {
+		return previewer.preview(state)
+	}
+	if previewer, ok := cmd.(Previewer); ok {
+		return previewer.Preview()
+	}
+
+	access := accessOf(cmd)
+	entry := PlanEntry{Command: cmd.Name(), Removes: access.Removes}
+	for _, path := range access.Writes {
+		err := previewTarget(&entry, state, path)
+		if err != nil {
+			return PlanEntry{}, err
+		}
+	}
+	return entry, nil
+}
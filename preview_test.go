@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestPlanChained(t *testing.T) {
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	writeTestFile(t, a, "data")
+	writeTestFile(t, c, "old")
+
+	batch := NewBatch(filepath.Join(dir, "wal.yaml"),
+		NewCmdMoveFile(a, b),
+		NewCmdCopyFile(b, c),
+		NewCmdCopyFile(c, a),
+		&delayCmd{path: b},
+		&delayCmd{path: filepath.Join(dir, "d")},
+	)
+	plan, err := batch.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []PlanEntry{
+		{Command: "move", Creates: []string{b}, Removes: []string{a}, Bytes: 4},
+		{Command: "copy", Overwrites: []string{c}, Bytes: 4},
+		{Command: "copy", Creates: []string{a}, Bytes: 4},
+		{Command: "delay", Overwrites: []string{b}},
+		{Command: "delay", Creates: []string{filepath.Join(dir, "d")}},
+	}
+	if len(plan) != len(want) {
+		t.Fatalf("plan = %+v, want %+v", plan, want)
+	}
+	for i := range want {
+		got := plan[i]
+		if got.Command != want[i].Command || got.Bytes != want[i].Bytes ||
+			!slices.Equal(got.Creates, want[i].Creates) ||
+			!slices.Equal(got.Overwrites, want[i].Overwrites) ||
+			!slices.Equal(got.Removes, want[i].Removes) {
+			t.Errorf("entry %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	// planning must not touch the filesystem
+	if _, err := os.Stat(b); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s was created by Plan", b)
+	}
+}
+
+func TestPlanMissingSource(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	writeTestFile(t, a, "data")
+
+	// the second move reads a file the first one moved away
+	batch := NewBatch(filepath.Join(dir, "wal.yaml"), NewCmdMoveFile(a, b), NewCmdMoveFile(a, b))
+	_, err := batch.Plan()
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Plan() = %v, want os.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/goccy/go-yaml"
+)
+
+type registryEntry struct {
+	// name is the canonical name an entry registered under an alias or a
+	// deprecated name resolves to
+	name       string
+	factory    func() Command
+	deprecated bool
+}
+
+// registry maps the names commands are logged with in the WAL to the types
+// they are decoded into
+var registry = make(map[string]registryEntry)
+
+func init() {
+	RegisterCommand("move", func() Command { return &CmdMoveFile{} })
+	RegisterCommand("copy", func() Command { return &CmdCopyFile{} })
+	RegisterCommand("assert_exists", func() Command { return &CmdAssertExists{} })
+	RegisterCommand("assert_absent", func() Command { return &CmdAssertAbsent{} })
+	RegisterCommand("assert_checksum", func() Command { return &CmdAssertChecksum{} })
+}
+
+// RegisterCommand makes commands logged as name decodable, factory returns
+// the zero value the command is decoded into
+func RegisterCommand(name string, factory func() Command) {
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("command %q is already registered", name))
+	}
+	registry[name] = registryEntry{name: name, factory: factory}
+}
+
+// RegisterAlias makes commands logged as alias decode as the command
+// registered as name
+func RegisterAlias(alias, name string) {
+	registerAlias(alias, name, false)
+}
+
+// RegisterDeprecated is like RegisterAlias but logs a warning whenever a
+// command is decoded through oldName, for WALs written before a rename
+func RegisterDeprecated(oldName, name string) {
+	registerAlias(oldName, name, true)
+}
+
+func registerAlias(alias, name string, deprecated bool) {
+	entry, ok := registry[name]
+	if !ok {
+		panic(fmt.Sprintf("cannot alias unregistered command %q", name))
+	}
+	if _, ok := registry[alias]; ok {
+		panic(fmt.Sprintf("command %q is already registered", alias))
+	}
+	entry.deprecated = deprecated
+	registry[alias] = entry
+}
+
+// DecodeCommand builds the command described by a decoded WAL entry. Commands
+// logged under an alias or deprecated name come back with their canonical
+// name.
+func DecodeCommand(raw map[string]any) (Command, error) {
+	name, _ := raw["name"].(string)
+	entry, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown command %q", name)
+	}
+	if entry.deprecated {
+		log.Printf("command name %q is deprecated, use %q\n", name, entry.name)
+	}
+
+	canonical := make(map[string]any, len(raw))
+	for k, v := range raw {
+		canonical[k] = v
+	}
+	canonical["name"] = entry.name
+
+	data, err := yaml.Marshal(canonical)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := entry.factory()
+	err = yaml.Unmarshal(data, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("decoding command %q: %w", name, err)
+	}
+	return cmd, nil
+}
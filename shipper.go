@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// A Shipper tails a local WAL and replicates every byte appended to it to a
+// remote HTTP collector, so an off-machine copy of the log is kept.
+//
+// Each shipment is a POST whose body is a raw slice of the WAL and whose
+// X-Wal-Offset header is the position of that slice in the file, so the
+// collector can append idempotently. The offset shipped so far is persisted
+// to a checkpoint file and shipping resumes from there after a restart.
+//
+// When the WAL is found shorter than the checkpoint, or its first bytes no
+// longer match those shipped, as after Namespace.Prune rewrote it, the WAL has
+// been replaced and shipping restarts from offset 0 with the X-Wal-Generation header
+// incremented, telling the collector to discard its copy and start anew.
+type Shipper struct {
+	WalPath        string
+	CheckpointPath string
+	Endpoint       string
+	Client         *http.Client
+
+	// MaxChunk caps how many bytes are sent per request, and MinInterval is
+	// the minimum time between two requests
+	MaxChunk    int
+	MinInterval time.Duration
+
+	// PollInterval is how long to wait for the WAL to grow once caught up,
+	// and failed requests are retried with exponential backoff between
+	// MinBackoff and MaxBackoff
+	PollInterval time.Duration
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+}
+
+func NewShipper(walPath, endpoint string) *Shipper {
+	walPath, err := filepath.Abs(walPath)
+	if err != nil {
+		panic(err)
+	}
+	return &Shipper{
+		WalPath:        walPath,
+		CheckpointPath: walPath + ".shipped",
+		Endpoint:       endpoint,
+		Client:         http.DefaultClient,
+		MaxChunk:       64 * 1024,
+		MinInterval:    100 * time.Millisecond,
+		PollInterval:   time.Second,
+		MinBackoff:     500 * time.Millisecond,
+		MaxBackoff:     time.Minute,
+	}
+}
+
+// Run ships the WAL until stop is closed
+func (s *Shipper) Run(stop <-chan struct{}) error {
+	if s.MaxChunk <= 0 {
+		return fmt.Errorf("shipper MaxChunk must be positive, got %d", s.MaxChunk)
+	}
+
+	checkpoint, err := s.readCheckpoint()
+	if err != nil {
+		return err
+	}
+	log.Printf("shipping WAL %s to %s from offset %d", s.WalPath, s.Endpoint, checkpoint.Offset)
+
+	backoff := s.MinBackoff
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(wait):
+		}
+
+		shipped, err := s.step(&checkpoint)
+		if errors.Is(err, errShipFailed) {
+			log.Printf("%v, retrying in %s\n", err, backoff)
+			wait = backoff
+			backoff = min(backoff*2, s.MaxBackoff)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		backoff = s.MinBackoff
+
+		wait = s.PollInterval
+		if shipped {
+			wait = s.MinInterval
+		}
+	}
+}
+
+// errShipFailed wraps errors sending a chunk, which are retried
+var errShipFailed = errors.New("shipping failed")
+
+// step ships the next chunk of the WAL and advances checkpoint past it. The
+// WAL is opened once, so the replacement check, the chunk and the new
+// fingerprint all come from the same file even if it is replaced meanwhile.
+func (s *Shipper) step(checkpoint *shipCheckpoint) (shipped bool, err error) {
+	walFile, err := os.Open(s.WalPath)
+	if errors.Is(err, os.ErrNotExist) {
+		walFile = nil
+	} else if err != nil {
+		return false, err
+	} else {
+		defer walFile.Close()
+	}
+
+	replaced, err := s.replaced(walFile, *checkpoint)
+	if err != nil {
+		return false, err
+	}
+	if replaced {
+		next := shipCheckpoint{Generation: checkpoint.Generation + 1}
+		next.Fingerprint, err = s.fingerprint(walFile, 0)
+		if err != nil {
+			return false, err
+		}
+		err = s.writeCheckpoint(next)
+		if err != nil {
+			return false, err
+		}
+		*checkpoint = next
+		log.Printf("WAL %s was replaced, shipping generation %d from offset 0\n", s.WalPath, checkpoint.Generation)
+	}
+
+	chunk, err := s.readChunk(walFile, checkpoint.Offset)
+	if err != nil || len(chunk) == 0 {
+		return false, err
+	}
+
+	err = s.ship(chunk, *checkpoint)
+	if err != nil {
+		return false, fmt.Errorf("%w: %d bytes at offset %d: %w", errShipFailed, len(chunk), checkpoint.Offset, err)
+	}
+
+	next := *checkpoint
+	next.Offset += int64(len(chunk))
+	next.Fingerprint, err = s.fingerprint(walFile, next.Offset)
+	if err != nil {
+		return false, err
+	}
+	err = s.writeCheckpoint(next)
+	if err != nil {
+		return false, err
+	}
+	*checkpoint = next
+	log.Printf("shipped WAL up to offset %d\n", checkpoint.Offset)
+	return true, nil
+}
+
+// replaced reports whether walFile, nil if the WAL does not exist, no longer
+// holds the bytes shipped so far
+func (s *Shipper) replaced(walFile *os.File, checkpoint shipCheckpoint) (bool, error) {
+	if walFile == nil {
+		return checkpoint.Offset > 0, nil
+	}
+
+	info, err := walFile.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() < checkpoint.Offset {
+		return true, nil
+	}
+
+	fingerprint, err := s.fingerprint(walFile, checkpoint.Offset)
+	if err != nil {
+		return false, err
+	}
+	return fingerprint != checkpoint.Fingerprint, nil
+}
+
+// fingerprintLen is how many leading bytes of the WAL identify it. Every WAL
+// starts with a batch_start record carrying a random batch ID, so a rewritten
+// WAL differs from the original within them.
+const fingerprintLen = 1024
+
+// fingerprint hashes the first bytes of walFile, up to offset
+func (s *Shipper) fingerprint(walFile *os.File, offset int64) (string, error) {
+	hash := sha256.New()
+	if walFile != nil {
+		_, err := io.Copy(hash, io.NewSectionReader(walFile, 0, min(offset, fingerprintLen)))
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readChunk returns up to MaxChunk bytes of walFile after offset, cut at the
+// last complete line so a record being written is not shipped half-way
+func (s *Shipper) readChunk(walFile *os.File, offset int64) ([]byte, error) {
+	if walFile == nil {
+		return nil, nil
+	}
+
+	buf := make([]byte, s.MaxChunk)
+	n, err := walFile.ReadAt(buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	end := bytes.LastIndexByte(buf[:n], '\n')
+	if end < 0 && n == s.MaxChunk {
+		// a single line longer than MaxChunk would otherwise never ship
+		return buf, nil
+	}
+	return buf[:end+1], nil
+}
+
+func (s *Shipper) ship(chunk []byte, checkpoint shipCheckpoint) error {
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint, bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/yaml")
+	req.Header.Set("X-Wal-Path", s.WalPath)
+	req.Header.Set("X-Wal-Offset", strconv.FormatInt(checkpoint.Offset, 10))
+	req.Header.Set("X-Wal-Generation", strconv.Itoa(checkpoint.Generation))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the body is drained so the connection can be reused
+	_, err = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+// A shipCheckpoint is how much of which generation of the WAL was shipped,
+// with the fingerprint of the shipped bytes
+type shipCheckpoint struct {
+	Offset      int64
+	Generation  int
+	Fingerprint string
+}
+
+// readCheckpoint reads a checkpoint written as
+// "<offset> <generation> <fingerprint>"
+func (s *Shipper) readCheckpoint() (shipCheckpoint, error) {
+	data, err := os.ReadFile(s.CheckpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		fingerprint, err := s.fingerprint(nil, 0)
+		return shipCheckpoint{Fingerprint: fingerprint}, err
+	}
+	if err != nil {
+		return shipCheckpoint{}, err
+	}
+
+	var checkpoint shipCheckpoint
+	_, err = fmt.Sscan(string(data), &checkpoint.Offset, &checkpoint.Generation, &checkpoint.Fingerprint)
+	if err != nil {
+		return shipCheckpoint{}, fmt.Errorf("reading checkpoint %s: %w", s.CheckpointPath, err)
+	}
+	return checkpoint, nil
+}
+
+// writeCheckpoint replaces the checkpoint through a rename so a crash never
+// leaves it truncated
+func (s *Shipper) writeCheckpoint(checkpoint shipCheckpoint) error {
+	tmpPath := s.CheckpointPath + ".tmp"
+	data := fmt.Sprintf("%d %d %s\n", checkpoint.Offset, checkpoint.Generation, checkpoint.Fingerprint)
+	err := os.WriteFile(tmpPath, []byte(data), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.CheckpointPath)
+}
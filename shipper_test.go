@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shipment is a request received by testCollector
+type shipment struct {
+	Offset     int64
+	Generation int
+	Body       string
+}
+
+// testCollector records shipments and fails the first failures of them
+type testCollector struct {
+	mu        sync.Mutex
+	failures  int
+	shipments []shipment
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	offset, _ := strconv.ParseInt(r.Header.Get("X-Wal-Offset"), 10, 64)
+	generation, _ := strconv.Atoi(r.Header.Get("X-Wal-Generation"))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shipments = append(c.shipments, shipment{offset, generation, string(body)})
+	if c.failures > 0 {
+		c.failures--
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+	}
+}
+
+func (c *testCollector) received() []shipment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.shipments)
+}
+
+func newTestShipper(t *testing.T, walPath string, collector *testCollector) *Shipper {
+	t.Helper()
+	server := httptest.NewServer(collector)
+	t.Cleanup(server.Close)
+
+	s := NewShipper(walPath, server.URL)
+	s.MinInterval = time.Millisecond
+	s.PollInterval = time.Millisecond
+	s.MinBackoff = time.Millisecond
+	s.MaxBackoff = 4 * time.Millisecond
+	return s
+}
+
+func stepTestShipper(t *testing.T, s *Shipper, checkpoint *shipCheckpoint) bool {
+	t.Helper()
+	shipped, err := s.step(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return shipped
+}
+
+func TestShipperResumesFromCheckpoint(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.yaml")
+	writeTestFile(t, walPath, "- a\n")
+	collector := &testCollector{}
+	s := newTestShipper(t, walPath, collector)
+
+	checkpoint, err := s.readCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stepTestShipper(t, s, &checkpoint)
+
+	// a new shipper, as after a restart, only ships what was appended
+	err = os.WriteFile(walPath, []byte("- a\n- b\n- partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = newTestShipper(t, walPath, collector)
+	checkpoint, err = s.readCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint.Offset != 4 {
+		t.Fatalf("checkpoint offset = %d, want 4", checkpoint.Offset)
+	}
+	stepTestShipper(t, s, &checkpoint)
+	if stepTestShipper(t, s, &checkpoint) {
+		t.Error("shipped a partial line")
+	}
+
+	want := []shipment{{0, 0, "- a\n"}, {4, 0, "- b\n"}}
+	if got := collector.received(); !slices.Equal(got, want) {
+		t.Errorf("shipments = %v, want %v", got, want)
+	}
+}
+
+func TestShipperBacksOff(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "wal.yaml")
+	writeTestFile(t, walPath, "- a\n")
+	collector := &testCollector{failures: 3}
+	s := newTestShipper(t, walPath, collector)
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- s.Run(stop) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(collector.received()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	err := <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every failed shipment is retried from the same offset
+	got := collector.received()
+	if len(got) != 4 {
+		t.Fatalf("shipments = %v, want 4", got)
+	}
+	for _, got := range got {
+		if got != (shipment{0, 0, "- a\n"}) {
+			t.Errorf("shipment = %v, want the first line at offset 0", got)
+		}
+	}
+	checkpoint, err := s.readCheckpoint()
+	if err != nil || checkpoint.Offset != 4 {
+		t.Errorf("checkpoint = %+v, %v, want offset 4", checkpoint, err)
+	}
+}
+
+func TestShipperRejectsEmptyChunk(t *testing.T) {
+	s := NewShipper(filepath.Join(t.TempDir(), "wal.yaml"), "http://127.0.0.1:0")
+	s.MaxChunk = 0
+	err := s.Run(make(chan struct{}))
+	if err == nil {
+		t.Error("Run() with MaxChunk 0 did not fail")
+	}
+}
+
+func TestShipperDetectsReplacedWAL(t *testing.T) {
+	tests := []struct {
+		name        string
+		replacement string
+	}{
+		{"shrunk", "- c\n"},
+		{"rewritten", "- c\n- d\n"},
+		{"removed", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			walPath := filepath.Join(t.TempDir(), "wal.yaml")
+			writeTestFile(t, walPath, "- a\n- b\n")
+			collector := &testCollector{}
+			s := newTestShipper(t, walPath, collector)
+
+			checkpoint, err := s.readCheckpoint()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stepTestShipper(t, s, &checkpoint)
+
+			want := []shipment{{0, 0, "- a\n- b\n"}}
+			if tt.replacement == "" {
+				err = os.Remove(walPath)
+			} else {
+				err = os.WriteFile(walPath, []byte(tt.replacement), 0644)
+				want = append(want, shipment{0, 1, tt.replacement})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			stepTestShipper(t, s, &checkpoint)
+
+			if checkpoint.Generation != 1 || checkpoint.Offset != int64(len(tt.replacement)) {
+				t.Errorf("checkpoint = %+v, want generation 1 at offset %d", checkpoint, len(tt.replacement))
+			}
+			if got := collector.received(); !slices.Equal(got, want) {
+				t.Errorf("shipments = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestShipperIgnoresMissingWAL(t *testing.T) {
+	s := newTestShipper(t, filepath.Join(t.TempDir(), "wal.yaml"), &testCollector{})
+	checkpoint, err := s.readCheckpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stepTestShipper(t, s, &checkpoint) {
+		t.Error("shipped a WAL that does not exist")
+	}
+	if _, err := os.Stat(s.CheckpointPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checkpoint written for a WAL that does not exist")
+	}
+}
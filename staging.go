@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/goccy/go-yaml"
+)
+
+// An ExecEnv is handed to commands implementing EnvCommand before they run,
+// giving them access to resources managed by the batch
+type ExecEnv struct {
+	// mu guards stagingDirs, as commands of a stage may run concurrently
+	mu          sync.Mutex
+	batchID     string
+	writeStatus func(StatusUpdate) error
+	stagingDirs map[string]string
+}
+
+// EnvCommand is implemented by commands that want the batch ExecEnv. The
+// env is set before the batch runs and reset to nil once it has ended.
+type EnvCommand interface {
+	SetEnv(env *ExecEnv)
+}
+
+func newExecEnv(batchID string, writeStatus func(StatusUpdate) error) *ExecEnv {
+	return &ExecEnv{
+		batchID:     batchID,
+		writeStatus: writeStatus,
+		stagingDirs: make(map[string]string),
+	}
+}
+
+// StagingDir returns the batch staging directory next to targetPath, creating
+// it on first use. Being on the same filesystem as the target, files staged
+// there can be moved into place with an atomic rename.
+func (e *ExecEnv) StagingDir(targetPath string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	parent := filepath.Dir(targetPath)
+	if dir, ok := e.stagingDirs[parent]; ok {
+		return dir, nil
+	}
+
+	dir := filepath.Join(parent, ".wal-staging-"+e.batchID)
+	err := os.Mkdir(dir, 0700)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	e.stagingDirs[parent] = dir
+
+	// the directory is logged so recovery can remove it after a crash
+	status := NewStatusUpdate(ActionStagingCreated, 0, nil)
+	status.Path = dir
+	err = e.writeStatus(*status)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Cleanup removes every staging directory created for the batch. It keeps
+// going past failures, as it also runs when the WAL can no longer be written,
+// and calling it again only retries the directories it failed to remove.
+func (e *ExecEnv) Cleanup() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var errs []error
+	for parent, dir := range e.stagingDirs {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		delete(e.stagingDirs, parent)
+
+		status := NewStatusUpdate(ActionStagingRemoved, 0, nil)
+		status.Path = dir
+		err = e.writeStatus(*status)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeStaged writes source to targetPath through a file in the staging
+// directory, so the target is replaced atomically
+func (e *ExecEnv) writeStaged(targetPath string, source io.Reader) error {
+	dir, err := e.StagingDir(targetPath)
+	if err != nil {
+		return err
+	}
+
+	staged, err := os.CreateTemp(dir, filepath.Base(targetPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged.Name())
+
+	_, err = io.Copy(staged, source)
+	if err != nil {
+		staged.Close()
+		return err
+	}
+
+	err = staged.Close()
+	if err != nil {
+		return err
+	}
+
+	// CreateTemp makes the file 0600, keep the mode an unstaged write gives
+	mode := os.FileMode(0644)
+	target, err := os.Stat(targetPath)
+	if err == nil {
+		mode = target.Mode().Perm()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.Chmod(staged.Name(), mode)
+	if err != nil {
+		return err
+	}
+	return os.Rename(staged.Name(), targetPath)
+}
+
+// RecoverStaging removes the staging directories that batches logged in the
+// WAL at walPath created but never removed, e.g. because the process crashed.
+// Namespace batches run it before they start; for other WALs it is the
+// recovery entry point to call while no batch is running on the WAL.
+func RecoverStaging(walPath string) error {
+	data, err := os.ReadFile(walPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []WalRecord
+	err = yaml.Unmarshal(data, &records)
+	if err != nil {
+		return walCorrupt(err)
+	}
+
+	leftover := make(map[string]bool)
+	for _, record := range records {
+		switch record.Action {
+		case ActionStagingCreated:
+			leftover[record.Path] = true
+		case ActionStagingRemoved:
+			delete(leftover, record.Path)
+		}
+	}
+
+	for dir := range leftover {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return err
+		}
+		log.Printf("removed leftover staging directory %s\n", dir)
+	}
+	return nil
+}
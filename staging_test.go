@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func stagingDirs(t *testing.T, dir string) []string {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(dir, ".wal-staging-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dirs
+}
+
+func TestExecuteAllStagedCopy(t *testing.T) {
+	dir := t.TempDir()
+	x, y := filepath.Join(dir, "x"), filepath.Join(dir, "y")
+	writeTestFile(t, x, "data")
+	writeTestFile(t, y, "old")
+	err := os.Chmod(y, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copyCmd := NewCmdCopyFile(x, y)
+	err = NewBatch(filepath.Join(dir, "wal.yaml"), copyCmd).ExecuteAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(y)
+	if err != nil || string(data) != "data" {
+		t.Errorf("%s = %q, %v, want %q", y, data, err, "data")
+	}
+	if info, err := os.Stat(y); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("%s mode = %v, %v, want 0600", y, info.Mode().Perm(), err)
+	}
+	if dirs := stagingDirs(t, dir); len(dirs) != 0 {
+		t.Errorf("staging directories left behind: %v", dirs)
+	}
+	if copyCmd.env != nil {
+		t.Error("command still holds the env of a finished batch")
+	}
+}
+
+func TestExecuteAllStagedCopyRolledBack(t *testing.T) {
+	dir := t.TempDir()
+	x, y := filepath.Join(dir, "x"), filepath.Join(dir, "y")
+	writeTestFile(t, x, "data")
+
+	copyCmd := NewCmdCopyFile(x, y)
+	err := NewBatch(filepath.Join(dir, "wal.yaml"), copyCmd, NewCmdAssertAbsent(x)).ExecuteAll()
+	if !errors.Is(err, ErrBatchRolledBack) {
+		t.Fatalf("ExecuteAll() = %v, want ErrBatchRolledBack", err)
+	}
+
+	if _, err := os.Stat(y); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s exists after rollback", y)
+	}
+	if dirs := stagingDirs(t, dir); len(dirs) != 0 {
+		t.Errorf("staging directories left behind: %v", dirs)
+	}
+	if copyCmd.env != nil {
+		t.Error("command still holds the env of a rolled back batch")
+	}
+}
+
+func TestRecoverStaging(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, ".wal-staging-crashed")
+	removed := filepath.Join(dir, ".wal-staging-done")
+	for _, path := range []string{leftover, removed} {
+		err := os.Mkdir(path, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(leftover, "y.123"), "partial")
+
+	// removed was logged as removed, so it is not the batch's to clean up
+	walPath := filepath.Join(dir, "wal.yaml")
+	writeTestFile(t, walPath, `- type: status_update
+  action: staging_created
+  path: `+leftover+`
+- type: status_update
+  action: staging_created
+  path: `+removed+`
+- type: status_update
+  action: staging_removed
+  path: `+removed+`
+`)
+
+	err := RecoverStaging(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s was not removed", leftover)
+	}
+	if _, err := os.Stat(removed); err != nil {
+		t.Errorf("%s was removed: %v", removed, err)
+	}
+}
+
+func TestNamespaceBatchRecoversStaging(t *testing.T) {
+	dir := t.TempDir()
+	x := filepath.Join(dir, "x")
+	writeTestFile(t, x, "data")
+	leftover := filepath.Join(dir, ".wal-staging-crashed")
+	err := os.Mkdir(leftover, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNamespace(dir, "project")
+	writeTestFile(t, n.WalPath(), "- type: status_update\n  action: staging_created\n  path: "+leftover+"\n")
+	err = n.NewBatch(NewCmdAssertExists(x)).ExecuteAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s was not recovered before the batch ran", leftover)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Record types and status actions are part of the WAL format and never
+// change once released, see the README for what each one means
+const (
+	RecordBatchStart   = "batch_start"
+	RecordStatusUpdate = "status_update"
+)
+
+// An Action is the wire value of what a status_update record reports
+type Action string
+
+const (
+	ActionExecuted         Action = "executed"
+	ActionBatchDone        Action = "batch_done"
+	ActionDeadlineExceeded Action = "deadline_exceeded"
+	ActionRollbackStarted  Action = "rollback_started"
+	ActionUndone           Action = "undone"
+	ActionRollbackFinished Action = "rollback_finished"
+	ActionStagingCreated   Action = "staging_created"
+	ActionStagingRemoved   Action = "staging_removed"
+)
+
+var (
+	// ErrBatchRolledBack wraps the error of a command that failed, after the
+	// commands executed before it have been undone
+	ErrBatchRolledBack = errors.New("batch rolled back")
+	// ErrRollbackFailed wraps the error of an undo that failed, leaving the
+	// batch partially applied
+	ErrRollbackFailed = errors.New("batch rollback failed")
+	// ErrWALCorrupt wraps errors decoding a WAL
+	ErrWALCorrupt = errors.New("WAL is corrupt")
+)
+
+func walCorrupt(err error) error {
+	return fmt.Errorf("%w: %w", ErrWALCorrupt, err)
+}
+
+// Exit codes of the command line tool, as documented in the README
+const (
+	ExitOK               = 0
+	ExitFailure          = 1
+	ExitRolledBack       = 2
+	ExitRollbackFailed   = 3
+	ExitWALCorrupt       = 4
+	ExitDeadlineExceeded = 5
+	ExitConflict         = 6
+	ExitLocked           = 7
+)
+
+// ExitCode maps an error returned by the batch API to an exit code
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, ErrRollbackFailed):
+		return ExitRollbackFailed
+	case errors.Is(err, ErrWALCorrupt):
+		return ExitWALCorrupt
+	case errors.Is(err, ErrBatchDeadlineExceeded):
+		return ExitDeadlineExceeded
+	case errors.Is(err, ErrBatchRolledBack):
+		return ExitRolledBack
+	case errors.Is(err, ErrBatchConflict):
+		return ExitConflict
+	case errors.Is(err, ErrNamespaceLocked):
+		return ExitLocked
+	default:
+		return ExitFailure
+	}
+}